@@ -6,15 +6,11 @@
 
 package netrom
 
-//#include <sys/socket.h>
-import "C"
-
 import (
 	"fmt"
 	"net"
 	"syscall"
 	"time"
-	"unsafe"
 )
 
 func NewNetROMBeacon(nrPort, mycall, dest, message string) (Beacon, error) {
@@ -59,21 +55,15 @@ func (b *NetROMBeacon) Now() error {
 	} else {
 		socket = fd(f)
 	}
-	defer socket.close()
 
 	if err := socket.bind(b.localAddr); err != nil {
+		socket.close()
 		return fmt.Errorf("bind: %s", err)
 	}
 
-	msg := C.CString(b.message)
-	_, err := C.sendto(
-		C.int(socket),
-		unsafe.Pointer(msg),
-		C.size_t(len(b.message)),
-		0,
-		(*C.struct_sockaddr)(unsafe.Pointer(&b.remoteAddr)),
-		C.socklen_t(unsafe.Sizeof(b.remoteAddr)),
-	)
+	pc := &NetROMPacketConn{io: newPktFD(socket), localAddr: NetROMAddr{b.localAddr}}
+	defer pc.Close()
 
+	_, err := pc.WriteTo([]byte(b.message), NetROMAddr{b.remoteAddr})
 	return err
 }
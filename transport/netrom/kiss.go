@@ -0,0 +1,189 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package netrom
+
+// This file implements NET/ROM's level 3 (routing) and level 4 (transport)
+// framing in pure Go, so that ListenNetROMKISS/DialNetROMKISS (kiss_conn.go)
+// can offer a *Conn/net.Listener pair on any platform, not just Linux with
+// libax25. Frames are exchanged as AX.25 UI frames carrying NET/ROM's
+// protocol ID over an ax25.TNC (github.com/la5nta/wl2k-go/transport/ax25),
+// typically a KISS TNC.
+
+import (
+	"errors"
+	"strings"
+)
+
+// nrPID is the AX.25 protocol ID used for NET/ROM frames.
+const nrPID = 0xcf
+
+// Level 4 opcodes (the low 3 bits of the opcode byte).
+const (
+	opConnReq byte = 1 + iota
+	opConnAck
+	opDiscReq
+	opDiscAck
+	opInfo
+	opInfoAck
+)
+
+const l4OpcodeMask = 0x07
+
+// Level 4 opcode flag bits (the high bits of the opcode byte).
+const (
+	flagChoke byte = 1 << 7
+	flagNak   byte = 1 << 6
+	flagMore  byte = 1 << 5 // INFO: more fragments follow in this record
+)
+
+// l3Header is the NET/ROM level 3 routing header prepended to every level 4
+// frame. TTL is decremented by each digipeating node and the frame is
+// dropped when it reaches zero.
+type l3Header struct {
+	Dest   Address
+	Origin Address
+	TTL    byte
+}
+
+const l3HeaderLen = 7 + 7 + 1
+
+func (h l3Header) marshal() []byte {
+	buf := make([]byte, 0, l3HeaderLen)
+	buf = append(buf, encodeCallsign(h.Dest)...)
+	buf = append(buf, encodeCallsign(h.Origin)...)
+	return append(buf, h.TTL)
+}
+
+func parseL3Header(p []byte) (l3Header, []byte, error) {
+	if len(p) < l3HeaderLen {
+		return l3Header{}, nil, errors.New("netrom: short L3 header")
+	}
+	h := l3Header{
+		Dest:   decodeCallsign(p[0:7]),
+		Origin: decodeCallsign(p[7:14]),
+		TTL:    p[14],
+	}
+	return h, p[l3HeaderLen:], nil
+}
+
+// l4Header is the NET/ROM level 4 (transport) header, carried as the
+// payload of an L3-routed frame.
+//
+// YourIndex/YourID identify the circuit at the peer (as assigned by the
+// peer); MyIndex/MyID identify it at this end. A CONNREQ carries the
+// originator's proposed MyIndex/MyID and leaves YourIndex/YourID unset.
+type l4Header struct {
+	YourIndex, YourID byte
+	MyIndex, MyID     byte
+	TxSeq, RxSeq      byte
+	Opcode            byte
+}
+
+const l4HeaderLen = 7
+
+func (h l4Header) marshal() []byte {
+	return []byte{h.YourIndex, h.YourID, h.MyIndex, h.MyID, h.TxSeq, h.RxSeq, h.Opcode}
+}
+
+func parseL4Header(p []byte) (l4Header, []byte, error) {
+	if len(p) < l4HeaderLen {
+		return l4Header{}, nil, errors.New("netrom: short L4 header")
+	}
+	h := l4Header{
+		YourIndex: p[0], YourID: p[1],
+		MyIndex: p[2], MyID: p[3],
+		TxSeq: p[4], RxSeq: p[5],
+		Opcode: p[6],
+	}
+	return h, p[l4HeaderLen:], nil
+}
+
+func (h l4Header) opType() byte { return h.Opcode & l4OpcodeMask }
+
+// encodeCallsign encodes a as a 7 byte AX.25 address field (six shifted
+// ASCII characters, space padded, followed by the shifted SSID byte).
+func encodeCallsign(a Address) []byte {
+	call := strings.ToUpper(strings.TrimSpace(a.Call))
+	buf := make([]byte, 7)
+	for i := 0; i < 6; i++ {
+		c := byte(' ')
+		if i < len(call) {
+			c = call[i]
+		}
+		buf[i] = c << 1
+	}
+	buf[6] = (a.SSID << 1) | 0x60
+	return buf
+}
+
+// decodeCallsign is the inverse of encodeCallsign.
+func decodeCallsign(p []byte) Address {
+	call := make([]byte, 0, 6)
+	for i := 0; i < 6; i++ {
+		c := p[i] >> 1
+		if c == ' ' {
+			break
+		}
+		call = append(call, c)
+	}
+	return Address{Call: string(call), SSID: (p[6] >> 1) & 0x0f}
+}
+
+// kissAddr adapts a plain Address into the addr interface NetROMAddr wraps,
+// for use by the KISS backend (which has no ax25Addr/cgo struct to lean on).
+type kissAddr Address
+
+func (a kissAddr) Address() Address { return Address(a) }
+
+// kissError implements net.Error for timeouts raised by the pure Go KISS
+// backend (ListenNetROMKISS/DialNetROMKISS), which has no syscall-level
+// errno to translate.
+type kissError struct {
+	msg     string
+	timeout bool
+}
+
+func (e kissError) Error() string   { return e.msg }
+func (e kissError) Timeout() bool   { return e.timeout }
+func (e kissError) Temporary() bool { return e.timeout }
+
+var errIOTimeout error = kissError{msg: "netrom: i/o timeout", timeout: true}
+var errDialTimeout error = kissError{msg: "netrom: dial timeout", timeout: true}
+
+// NodeRoute is a single entry learned from a classic NET/ROM nodes
+// broadcast: alias announces Callsign as reachable via Neighbour with the
+// given Quality (0-255, higher is better).
+type NodeRoute struct {
+	Alias     string
+	Callsign  Address
+	Neighbour Address
+	Quality   byte
+}
+
+const nodesBroadcastHeader = "NODES"
+
+// parseNodesBroadcast parses the payload of a classic NET/ROM nodes
+// broadcast (as sent as an INFO frame to the well-known "NODES" alias/port)
+// into the routes it advertises. INP3 (compressed) broadcasts are not
+// supported and are rejected with an error.
+func parseNodesBroadcast(p []byte) ([]NodeRoute, error) {
+	if len(p) < 7+1 || string(p[0:len(nodesBroadcastHeader)]) != nodesBroadcastHeader {
+		return nil, errors.New("netrom: not a classic nodes broadcast")
+	}
+	p = p[7:] // "NODES" + sending node's SSID byte padding
+
+	const entryLen = 6 + 7 + 7 + 1
+	var routes []NodeRoute
+	for len(p) >= entryLen {
+		routes = append(routes, NodeRoute{
+			Alias:     strings.TrimRight(string(p[0:6]), " "),
+			Callsign:  decodeCallsign(p[6:13]),
+			Neighbour: decodeCallsign(p[13:20]),
+			Quality:   p[20],
+		})
+		p = p[entryLen:]
+	}
+	return routes, nil
+}
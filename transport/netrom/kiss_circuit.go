@@ -0,0 +1,458 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package netrom
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport/ax25"
+)
+
+// Default level 4 transport parameters (see kissCircuit), matching the
+// values commonly used by classic NET/ROM implementations.
+const (
+	defaultT1     = 10 * time.Second       // retransmission timer
+	defaultT2     = 250 * time.Millisecond // ack-delay timer
+	defaultTN2    = 5                      // retransmission retry count
+	defaultWindow = 4                      // max unacked frames in flight
+	maxInfoLen    = 236                    // max bytes of payload per INFO frame
+)
+
+// maxRecvBuf bounds how much unread application data a kissCircuit will
+// hold before choking the peer (see handleInfo); recvBufLowWater is how far
+// a Read must drain it before we tell the peer to resume (see Read).
+const (
+	maxRecvBuf      = 8 * maxInfoLen
+	recvBufLowWater = maxRecvBuf / 2
+)
+
+var errCircuitReset = errors.New("netrom: circuit reset by peer")
+
+// KISSParams overrides the level 4 sliding-window transport parameters (see
+// kissCircuit) used by a KISS-backed circuit. The zero value of each field
+// uses the corresponding package default.
+type KISSParams struct {
+	T1     time.Duration // retransmission timer; <= 0 uses defaultT1
+	T2     time.Duration // ack-delay timer; <= 0 uses defaultT2
+	TN2    int           // retransmission retry count; <= 0 uses defaultTN2
+	Window int           // max unacked frames in flight (1-7); <= 0 uses defaultWindow
+}
+
+// orDefaults returns p with every unset (<= 0) field replaced by its
+// package default.
+func (p KISSParams) orDefaults() KISSParams {
+	if p.T1 <= 0 {
+		p.T1 = defaultT1
+	}
+	if p.T2 <= 0 {
+		p.T2 = defaultT2
+	}
+	if p.TN2 <= 0 {
+		p.TN2 = defaultTN2
+	}
+	if p.Window <= 0 {
+		p.Window = defaultWindow
+	} else if p.Window > 7 {
+		// The mod-8 sequence space can't distinguish more than 7 frames in
+		// flight from none at all.
+		p.Window = 7
+	}
+	return p
+}
+
+type pendingFrame struct {
+	seq  byte
+	data []byte
+}
+
+// kissCircuit implements connIO as a NET/ROM level 4 transport connection
+// carried over an engine's ax25.TNC. It provides the same sliding-window,
+// timer-driven reliability a libax25-backed netFD gets for free from the
+// kernel's NET/ROM stack.
+//
+// Unlike netFD, there is no fd to select(2) on, so Read/Write block on a
+// notify channel that is closed (and replaced) by wakeLocked whenever state
+// a blocked caller might care about changes: more data arrives, the send
+// window opens up, a deadline is set, or the circuit closes.
+type kissCircuit struct {
+	eng *kissEngine
+
+	localAddr, remoteAddr Address
+	path                  []ax25.Address // digipeater path to remoteAddr, if any
+
+	myIndex, myID     byte
+	yourIndex, yourID byte
+
+	t1, t2 time.Duration
+	tn2    int
+	window int
+
+	deadlines
+
+	mu         sync.Mutex
+	notify     chan struct{}
+	txSeq      byte // next sequence number to assign to an outgoing INFO frame
+	rxSeq      byte // next sequence number expected from the peer
+	unacked    []pendingFrame
+	retries    int
+	t1Timer    *time.Timer
+	peerChoked bool // we must not send while true
+	weChoked   bool // true while we've told the peer to pause (recvBuf over maxRecvBuf)
+	recvBuf    bytes.Buffer
+	closed     bool
+
+	releaseOnce sync.Once  // guards releasing eng; see release
+	acceptCh    chan error // signalled once a CONNACK/DISCACK arrives for a dialed circuit
+}
+
+func newKISSCircuit(eng *kissEngine, local, remote Address, path []ax25.Address, myIndex, myID byte, params KISSParams) *kissCircuit {
+	params = params.orDefaults()
+	return &kissCircuit{
+		eng:        eng,
+		localAddr:  local,
+		remoteAddr: remote,
+		path:       path,
+		myIndex:    myIndex,
+		myID:       myID,
+		t1:         params.T1,
+		t2:         params.T2,
+		tn2:        params.TN2,
+		window:     params.Window,
+		notify:     make(chan struct{}),
+		acceptCh:   make(chan error, 1),
+	}
+}
+
+// release drops this circuit's reference to eng, acquired for it in
+// allocCircuit's caller (DialNetROMKISSParams or handleConnReq). A circuit
+// can close via three independent paths (an explicit Close, onT1 giving up
+// after tn2 retries, or a DISCREQ/DISCACK from the peer), so release is
+// idempotent.
+func (c *kissCircuit) release() {
+	c.releaseOnce.Do(func() { c.eng.release() })
+}
+
+func (c *kissCircuit) key() uint16 { return circuitKey(c.myIndex, c.myID) }
+
+// wakeLocked wakes every goroutine currently blocked in Read/Write/waitLocked.
+// c.mu must be held.
+func (c *kissCircuit) wakeLocked() {
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// waitLocked blocks until woken, the read/write deadline (whichever applies)
+// expires, or the circuit closes in the meantime, re-acquiring c.mu before
+// returning. c.mu must be held on entry.
+func (c *kissCircuit) waitLocked(write bool) error {
+	notify := c.notify
+	var deadline time.Time
+	if write {
+		deadline, _ = c.deadlines.write()
+	} else {
+		deadline, _ = c.deadlines.read()
+	}
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return errIOTimeout
+	}
+
+	var after <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		after = timer.C
+	}
+	select {
+	case <-notify:
+		return nil
+	case <-after:
+		return errIOTimeout
+	}
+}
+
+// SetReadDeadline overrides the promoted deadlines.SetReadDeadline to also
+// wake any Read currently blocked in waitLocked, so it notices the new
+// deadline immediately instead of on its next unrelated wakeup.
+func (c *kissCircuit) SetReadDeadline(t time.Time) {
+	c.deadlines.SetReadDeadline(t)
+	c.mu.Lock()
+	c.wakeLocked()
+	c.mu.Unlock()
+}
+
+// SetWriteDeadline is the Write counterpart to SetReadDeadline.
+func (c *kissCircuit) SetWriteDeadline(t time.Time) {
+	c.deadlines.SetWriteDeadline(t)
+	c.mu.Lock()
+	c.wakeLocked()
+	c.mu.Unlock()
+}
+
+// --- connIO ---
+
+func (c *kissCircuit) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	for c.recvBuf.Len() == 0 && !c.closed {
+		if err := c.waitLocked(false); err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+	}
+	if c.recvBuf.Len() == 0 && c.closed {
+		c.mu.Unlock()
+		return 0, io.EOF
+	}
+	n, err := c.recvBuf.Read(p)
+
+	// If draining p made us give up on choking the peer, tell it so right
+	// away: unlike the choke itself (piggy-backed on the ack for their next
+	// INFO), a fully choked peer has nothing left to send an ack off of.
+	unchoke := c.weChoked && c.recvBuf.Len() <= recvBufLowWater
+	if unchoke {
+		c.weChoked = false
+	}
+	yourIndex, yourID, rxSeq := c.yourIndex, c.yourID, c.rxSeq
+	c.mu.Unlock()
+
+	if unchoke {
+		c.eng.sendL4(c.remoteAddr, c.path, l4Header{
+			YourIndex: yourIndex, YourID: yourID,
+			MyIndex: c.myIndex, MyID: c.myID,
+			RxSeq:  rxSeq,
+			Opcode: opInfoAck,
+		}, nil)
+	}
+	return n, err
+}
+
+func (c *kissCircuit) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxInfoLen {
+			n = maxInfoLen
+		}
+		if err := c.writeChunk(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// writeChunk sends a single INFO frame, blocking while the send window is
+// full or the peer has us choked.
+func (c *kissCircuit) writeChunk(p []byte) error {
+	c.mu.Lock()
+	for !c.closed && (len(c.unacked) >= c.window || c.peerChoked) {
+		if err := c.waitLocked(true); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	if c.closed {
+		c.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+
+	seq := c.txSeq
+	c.txSeq = (c.txSeq + 1) % 8
+	data := append([]byte(nil), p...)
+	c.unacked = append(c.unacked, pendingFrame{seq: seq, data: data})
+	if c.t1Timer == nil {
+		c.startT1Locked()
+	}
+	rxSeq := c.rxSeq
+	c.mu.Unlock()
+
+	return c.eng.sendL4(c.remoteAddr, c.path, l4Header{
+		YourIndex: c.yourIndex, YourID: c.yourID,
+		MyIndex: c.myIndex, MyID: c.myID,
+		TxSeq: seq, RxSeq: rxSeq,
+		Opcode: opInfo,
+	}, data)
+}
+
+func (c *kissCircuit) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.stopT1Locked()
+	c.wakeLocked()
+	yourIndex, yourID := c.yourIndex, c.yourID
+	c.mu.Unlock()
+
+	c.eng.removeCircuit(c)
+	err := c.eng.sendL4(c.remoteAddr, c.path, l4Header{
+		YourIndex: yourIndex, YourID: yourID,
+		MyIndex: c.myIndex, MyID: c.myID,
+		Opcode: opDiscReq,
+	}, nil)
+	c.release()
+	return err
+}
+
+// --- timers ---
+
+func (c *kissCircuit) startT1Locked() {
+	c.retries = 0
+	c.t1Timer = time.AfterFunc(c.t1, c.onT1)
+}
+
+func (c *kissCircuit) stopT1Locked() {
+	if c.t1Timer != nil {
+		c.t1Timer.Stop()
+		c.t1Timer = nil
+	}
+}
+
+// onT1 fires when we haven't heard an INFOACK within t1: resend the oldest
+// unacked frame, giving up (and resetting the circuit) after tn2 retries.
+func (c *kissCircuit) onT1() {
+	c.mu.Lock()
+	if c.closed || len(c.unacked) == 0 {
+		c.t1Timer = nil
+		c.mu.Unlock()
+		return
+	}
+	c.retries++
+	if c.retries > c.tn2 {
+		c.closed = true
+		c.wakeLocked()
+		c.mu.Unlock()
+		c.eng.removeCircuit(c)
+		c.release()
+		return
+	}
+	oldest := c.unacked[0]
+	yourIndex, yourID, rxSeq := c.yourIndex, c.yourID, c.rxSeq
+	c.t1Timer = time.AfterFunc(c.t1, c.onT1)
+	c.mu.Unlock()
+
+	c.eng.sendL4(c.remoteAddr, c.path, l4Header{
+		YourIndex: yourIndex, YourID: yourID,
+		MyIndex: c.myIndex, MyID: c.myID,
+		TxSeq: oldest.seq, RxSeq: rxSeq,
+		Opcode: opInfo,
+	}, oldest.data)
+}
+
+// --- inbound frame handling, invoked by the engine's receive loop ---
+
+func (c *kissCircuit) handle(h l4Header, payload []byte) {
+	switch h.opType() {
+	case opConnAck:
+		c.mu.Lock()
+		c.yourIndex, c.yourID = h.MyIndex, h.MyID
+		c.wakeLocked()
+		c.mu.Unlock()
+		select {
+		case c.acceptCh <- nil:
+		default:
+		}
+	case opDiscAck, opDiscReq:
+		c.mu.Lock()
+		c.closed = true
+		c.wakeLocked()
+		c.mu.Unlock()
+		c.eng.removeCircuit(c)
+		c.release()
+		select {
+		case c.acceptCh <- errCircuitReset:
+		default:
+		}
+	case opInfo:
+		c.handleInfo(h, payload)
+	case opInfoAck:
+		c.handleInfoAck(h)
+	}
+}
+
+func (c *kissCircuit) handleInfo(h l4Header, payload []byte) {
+	c.mu.Lock()
+	inOrder := h.TxSeq == c.rxSeq
+	if inOrder {
+		c.rxSeq = (c.rxSeq + 1) % 8
+		c.recvBuf.Write(payload)
+	}
+	rxSeq := c.rxSeq
+	yourIndex, yourID := c.yourIndex, c.yourID
+	// Choke the peer once the application falls far enough behind draining
+	// recvBuf via Read; Read lifts the choke once it catches back up.
+	c.weChoked = c.recvBuf.Len() >= maxRecvBuf
+	choke := c.weChoked
+	c.wakeLocked()
+	c.mu.Unlock()
+
+	ack := l4Header{
+		YourIndex: yourIndex, YourID: yourID,
+		MyIndex: c.myIndex, MyID: c.myID,
+		RxSeq:  rxSeq,
+		Opcode: opInfoAck,
+	}
+	if choke {
+		ack.Opcode |= flagChoke
+	}
+	if !inOrder {
+		// Ask the peer to resend from rxSeq; no point delaying this one.
+		ack.Opcode |= flagNak
+		c.eng.sendL4(c.remoteAddr, c.path, ack, nil)
+		return
+	}
+
+	// Hold the ACK for t2 before sending it. A Write in the meantime does not
+	// cancel it: the ACK is sent even if an INFO frame has already carried
+	// rxSeq back to the peer.
+	time.AfterFunc(c.t2, func() { c.eng.sendL4(c.remoteAddr, c.path, ack, nil) })
+}
+
+func (c *kissCircuit) handleInfoAck(h l4Header) {
+	c.mu.Lock()
+	// c.unacked is ordered oldest-first and its seqs are contiguous mod 8, so
+	// the frames RxSeq acknowledges are exactly the prefix up to (but not
+	// including) the one seq'd RxSeq itself, if still outstanding; if none
+	// match, RxSeq acknowledges all of them. This holds for any window up to
+	// 7, unlike a fixed half-window (mod-8 "before") comparison.
+	i := 0
+	for i < len(c.unacked) && c.unacked[i].seq != h.RxSeq {
+		i++
+	}
+	c.unacked = append(c.unacked[:0], c.unacked[i:]...)
+	c.peerChoked = h.Opcode&flagChoke != 0
+	if len(c.unacked) == 0 {
+		c.stopT1Locked()
+	} else if h.Opcode&flagNak != 0 {
+		c.stopT1Locked()
+		c.startT1Locked()
+	}
+	resend := append([]pendingFrame(nil), c.unacked...)
+	yourIndex, yourID, rxSeq := c.yourIndex, c.yourID, c.rxSeq
+	nak := h.Opcode&flagNak != 0
+	c.wakeLocked()
+	c.mu.Unlock()
+
+	if !nak {
+		return
+	}
+	for _, f := range resend {
+		c.eng.sendL4(c.remoteAddr, c.path, l4Header{
+			YourIndex: yourIndex, YourID: yourID,
+			MyIndex: c.myIndex, MyID: c.myID,
+			TxSeq: f.seq, RxSeq: rxSeq,
+			Opcode: opInfo,
+		}, f.data)
+	}
+}
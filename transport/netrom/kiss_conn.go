@@ -0,0 +1,403 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package netrom
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport/ax25"
+)
+
+// splitPath splits a comma separated digipeater path into trimmed,
+// non-empty callsigns.
+func splitPath(path string) []string {
+	var calls []string
+	for _, p := range strings.Split(path, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			calls = append(calls, p)
+		}
+	}
+	return calls
+}
+
+func circuitKey(index, id byte) uint16 { return uint16(index)<<8 | uint16(id) }
+
+// kissEngine demultiplexes NET/ROM frames received over an ax25.TNC into
+// per-circuit queues, and serializes outgoing frames back out over it. One
+// engine backs every ListenNetROMKISS/DialNetROMKISS call sharing a given
+// ax25.TNC and local callsign (see acquireKISSEngine): a station routinely
+// dials out while also listening, or dials several circuits at once, over
+// the very same physical TNC, and only one goroutine may ever read
+// tnc.Next() or its frames would be split at random between engines.
+type kissEngine struct {
+	tnc       ax25.TNC
+	localAddr Address
+	params    KISSParams // applied to circuits this engine accepts
+
+	mu        sync.Mutex
+	nextIndex byte
+	circuits  map[uint16]*kissCircuit
+	accept    chan *kissCircuit // non-nil while a kissListener is accepting
+	routes    map[string]NodeRoute
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	refs int // guarded by kissEnginesMu, not mu; see acquireKISSEngine
+}
+
+// kissEngines shares one kissEngine per ax25.TNC, refcounted by
+// acquireKISSEngine/addRef/release.
+var (
+	kissEnginesMu sync.Mutex
+	kissEngines   = make(map[ax25.TNC]*kissEngine)
+)
+
+// acquireKISSEngine returns the kissEngine demultiplexing tnc for mycall,
+// creating one (and starting its receive loop) the first time tnc is seen,
+// or sharing the existing one otherwise. The returned engine carries one
+// reference on the caller's behalf, to be matched by a release() once the
+// caller (a kissListener or kissCircuit) is done with it.
+func acquireKISSEngine(tnc ax25.TNC, mycall string) (*kissEngine, error) {
+	local := AddressFromString(mycall)
+
+	kissEnginesMu.Lock()
+	defer kissEnginesMu.Unlock()
+
+	if e, ok := kissEngines[tnc]; ok {
+		if e.localAddr != local {
+			return nil, fmt.Errorf("netrom: TNC already in use as %s, not %s", e.localAddr, local)
+		}
+		e.refs++
+		return e, nil
+	}
+
+	e := &kissEngine{
+		tnc:       tnc,
+		localAddr: local,
+		params:    KISSParams{}.orDefaults(),
+		circuits:  make(map[uint16]*kissCircuit),
+		routes:    make(map[string]NodeRoute),
+		closed:    make(chan struct{}),
+		refs:      1,
+	}
+	kissEngines[tnc] = e
+	go e.loop()
+	return e, nil
+}
+
+// addRef registers another reference (typically a newly accepted circuit)
+// against an already-acquired engine.
+func (e *kissEngine) addRef() {
+	kissEnginesMu.Lock()
+	e.refs++
+	kissEnginesMu.Unlock()
+}
+
+// release drops a reference obtained from acquireKISSEngine or addRef. Once
+// the last listener or circuit sharing e releases it, e is forgotten and
+// its tnc is closed, which in turn stops loop (tnc.Next() starts erroring).
+func (e *kissEngine) release() error {
+	kissEnginesMu.Lock()
+	e.refs--
+	if e.refs > 0 {
+		kissEnginesMu.Unlock()
+		return nil
+	}
+	delete(kissEngines, e.tnc)
+	kissEnginesMu.Unlock()
+	return e.tnc.Close()
+}
+
+// loop reads frames from the TNC until it errors (typically because the
+// TNC, and with it the underlying KISS port, was closed), dispatching each
+// NET/ROM frame to the circuit or listener it belongs to.
+func (e *kissEngine) loop() {
+	for {
+		frame, err := e.tnc.Next()
+		if err != nil {
+			e.closeOnce.Do(func() { close(e.closed) })
+			return
+		}
+		if frame.PID != nrPID {
+			continue // not NET/ROM
+		}
+
+		l3, rest, err := parseL3Header(frame.Payload)
+		if err != nil {
+			continue
+		}
+		if l3.Dest.Call == nodesBroadcastHeader {
+			if routes, err := parseNodesBroadcast(rest); err == nil {
+				e.learnRoutes(routes)
+			}
+			continue
+		}
+		if l3.Dest.Call != e.localAddr.Call {
+			continue // not addressed to us; we don't digipeat
+		}
+
+		l4, payload, err := parseL4Header(rest)
+		if err != nil {
+			continue
+		}
+
+		if l4.opType() == opConnReq {
+			e.handleConnReq(l3.Origin, l4)
+			continue
+		}
+
+		e.mu.Lock()
+		c := e.circuits[circuitKey(l4.YourIndex, l4.YourID)]
+		e.mu.Unlock()
+		if c != nil {
+			c.handle(l4, payload)
+		}
+	}
+}
+
+func (e *kissEngine) learnRoutes(routes []NodeRoute) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range routes {
+		e.routes[r.Callsign.String()] = r
+	}
+}
+
+// allocCircuit reserves the next free circuit index/ID pair and registers a
+// new circuit for remote (digipeated via path, if any) under it, using
+// params for its level 4 transport parameters.
+func (e *kissEngine) allocCircuit(remote Address, path []ax25.Address, params KISSParams) *kissCircuit {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	index := e.nextIndex
+	e.nextIndex++
+	c := newKISSCircuit(e, e.localAddr, remote, path, index, index, params)
+	e.circuits[c.key()] = c
+	return c
+}
+
+func (e *kissEngine) removeCircuit(c *kissCircuit) {
+	e.mu.Lock()
+	delete(e.circuits, c.key())
+	e.mu.Unlock()
+}
+
+// handleConnReq answers an incoming CONNREQ with a CONNACK and hands the new
+// circuit to a waiting kissListener.Accept, if one is listening.
+func (e *kissEngine) handleConnReq(origin Address, h l4Header) {
+	e.mu.Lock()
+	accept := e.accept
+	params := e.params
+	e.mu.Unlock()
+	if accept == nil {
+		return
+	}
+
+	// The accepted circuit gets its own reference to e, released when it
+	// (independently of any kissListener) is closed.
+	e.addRef()
+	c := e.allocCircuit(origin, nil, params)
+	c.yourIndex, c.yourID = h.MyIndex, h.MyID
+
+	if err := e.sendL4(origin, nil, l4Header{
+		YourIndex: c.yourIndex, YourID: c.yourID,
+		MyIndex: c.myIndex, MyID: c.myID,
+		Opcode: opConnAck,
+	}, []byte{byte(c.window)}); err != nil {
+		e.removeCircuit(c)
+		e.release()
+		return
+	}
+
+	select {
+	case accept <- c:
+	case <-e.closed:
+		e.removeCircuit(c)
+		e.release()
+	}
+}
+
+// sendL4 wraps h/payload in a level 3 routing header and sends it as an
+// AX.25 UI frame addressed to remote, digipeated via path if non-empty.
+func (e *kissEngine) sendL4(remote Address, path []ax25.Address, h l4Header, payload []byte) error {
+	buf := l3Header{Dest: remote, Origin: e.localAddr, TTL: 7}.marshal()
+	buf = append(buf, h.marshal()...)
+	buf = append(buf, payload...)
+
+	return e.tnc.Write(ax25.Frame{
+		Dst:         ax25.AddressFromString(remote.String()),
+		Src:         ax25.AddressFromString(e.localAddr.String()),
+		Digipeaters: path,
+		Control:     0x03, // UI frame
+		PID:         nrPID,
+		Payload:     buf,
+	})
+}
+
+// parseDigipeaterPath splits a comma separated AX.25 digipeater path (e.g.
+// "WIDE1-1,WIDE2-2") into the addresses ax25.Frame expects. An empty path
+// yields a nil (direct) digipeater list.
+func parseDigipeaterPath(path string) []ax25.Address {
+	if path == "" {
+		return nil
+	}
+	calls := splitPath(path)
+	addrs := make([]ax25.Address, len(calls))
+	for i, call := range calls {
+		addrs[i] = ax25.AddressFromString(call)
+	}
+	return addrs
+}
+
+// kissListener implements net.Listener for KISS-backed NET/ROM circuits; see
+// ListenNetROMKISS.
+type kissListener struct {
+	eng       *kissEngine
+	localAddr NetROMAddr
+	accept    chan *kissCircuit
+
+	closeOnce sync.Once
+}
+
+func (ln *kissListener) Addr() net.Addr { return ln.localAddr }
+
+func (ln *kissListener) Close() error {
+	var err error
+	ln.closeOnce.Do(func() {
+		ln.eng.mu.Lock()
+		ln.eng.accept = nil
+		ln.eng.mu.Unlock()
+		err = ln.eng.release()
+	})
+	return err
+}
+
+func (ln *kissListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.accept:
+		return &Conn{
+			io:         c,
+			localAddr:  ln.localAddr,
+			remoteAddr: NetROMAddr{kissAddr(c.remoteAddr)},
+		}, nil
+	case <-ln.eng.closed:
+		return nil, errors.New("netrom: KISS TNC closed")
+	}
+}
+
+// ListenNetROMKISS announces the local callsign mycall over tnc, accepting
+// incoming NET/ROM connections carried as AX.25 UI frames, using the
+// package default level 4 transport parameters. Unlike ListenNetROM, this
+// works on any platform Go and the given ax25.TNC driver support, without an
+// AX.25 stack in the kernel.
+//
+// alias is the node's NET/ROM alias as it would be announced in this
+// node's own nodes broadcasts; it is accepted for parity with a
+// nrports-style configuration but is not otherwise used yet, since this
+// backend doesn't originate broadcasts of its own.
+func ListenNetROMKISS(tnc ax25.TNC, mycall, alias string) (net.Listener, error) {
+	return ListenNetROMKISSParams(tnc, mycall, alias, KISSParams{})
+}
+
+// ListenNetROMKISSParams is ListenNetROMKISS with the level 4 transport
+// parameters (see KISSParams) used for circuits it accepts overridden.
+//
+// Listening on (or dialing out over, see DialNetROMKISSParams) the same tnc
+// more than once shares a single kissEngine between the calls, since only
+// one goroutine may read tnc.Next(); every one of those calls must agree on
+// mycall.
+func ListenNetROMKISSParams(tnc ax25.TNC, mycall, alias string, params KISSParams) (net.Listener, error) {
+	if mycall == "" {
+		return nil, errors.New("netrom: empty mycall")
+	}
+
+	eng, err := acquireKISSEngine(tnc, mycall)
+	if err != nil {
+		return nil, err
+	}
+	accept := make(chan *kissCircuit)
+	eng.mu.Lock()
+	eng.accept = accept
+	eng.params = params.orDefaults()
+	eng.mu.Unlock()
+
+	return &kissListener{
+		eng:       eng,
+		localAddr: NetROMAddr{kissAddr(eng.localAddr)},
+		accept:    accept,
+	}, nil
+}
+
+// DialNetROMKISS connects to targetcall over tnc using mycall as the local
+// address, optionally digipeating via path (a comma separated list of
+// digipeater callsigns, or empty for a direct connection), using the
+// package default level 4 transport parameters. It produces the same *Conn
+// type ListenNetROM/DialNetROM do, so callers don't need to know which
+// backend handled the call.
+func DialNetROMKISS(tnc ax25.TNC, mycall, path, targetcall string, timeout time.Duration) (*Conn, error) {
+	return DialNetROMKISSParams(tnc, mycall, path, targetcall, timeout, KISSParams{})
+}
+
+// DialNetROMKISSParams is DialNetROMKISS with the level 4 transport
+// parameters (see KISSParams) used for the dialed circuit overridden.
+func DialNetROMKISSParams(tnc ax25.TNC, mycall, path, targetcall string, timeout time.Duration, params KISSParams) (*Conn, error) {
+	if mycall == "" || targetcall == "" {
+		return nil, errors.New("netrom: empty callsign")
+	}
+
+	eng, err := acquireKISSEngine(tnc, mycall)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*Conn, error) {
+		eng.release()
+		return nil, err
+	}
+
+	remote := AddressFromString(targetcall)
+	digipeaters := parseDigipeaterPath(path)
+	c := eng.allocCircuit(remote, digipeaters, params)
+
+	if err := eng.sendL4(remote, digipeaters, l4Header{
+		MyIndex: c.myIndex, MyID: c.myID,
+		Opcode: opConnReq,
+	}, []byte{byte(c.window)}); err != nil {
+		eng.removeCircuit(c)
+		return fail(err)
+	}
+
+	var after <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		after = timer.C
+	}
+	select {
+	case err := <-c.acceptCh:
+		if err != nil {
+			// handle has already dropped c's engine reference; c.release
+			// is idempotent, so this does not drop it a second time.
+			eng.removeCircuit(c)
+			c.release()
+			return nil, err
+		}
+	case <-after:
+		eng.removeCircuit(c)
+		c.release()
+		return nil, errDialTimeout
+	}
+
+	return &Conn{
+		io:         c,
+		localAddr:  NetROMAddr{kissAddr(eng.localAddr)},
+		remoteAddr: NetROMAddr{kissAddr(remote)},
+	}, nil
+}
@@ -20,12 +20,13 @@ package netrom
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/la5nta/wl2k-go/transport"
@@ -59,8 +60,22 @@ type Address struct {
 	SSID uint8
 }
 
+// connIO is the I/O implementation backing a Conn. It is supplied by the
+// backend (netFD for libax25, kissCircuit for a KISS TNC) so that Conn
+// itself stays platform-independent while keeping full control over how
+// bytes are moved and errors are translated, instead of delegating to an
+// embedded io.ReadWriteCloser.
+type connIO interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	SetReadDeadline(time.Time)
+	SetWriteDeadline(time.Time)
+}
+
 type Conn struct {
-	io.ReadWriteCloser
+	io         connIO
 	localAddr  NetROMAddr
 	remoteAddr NetROMAddr
 }
@@ -79,18 +94,224 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.remoteAddr
 }
 
-func (c *Conn) ok() bool { return c != nil }
+func (c *Conn) ok() bool { return c != nil && c.io != nil }
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if !c.ok() {
+		return 0, syscall.EINVAL
+	}
+	return c.io.Read(p)
+}
 
+func (c *Conn) Write(p []byte) (int, error) {
+	if !c.ok() {
+		return 0, syscall.EINVAL
+	}
+	return c.io.Write(p)
+}
+
+func (c *Conn) Close() error {
+	if !c.ok() {
+		return syscall.EINVAL
+	}
+	return c.io.Close()
+}
+
+// SetDeadline implements the net.Conn interface.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return errors.New(`SetDeadline not implemented`)
+	if !c.ok() {
+		return syscall.EINVAL
+	}
+	c.io.SetReadDeadline(t)
+	c.io.SetWriteDeadline(t)
+	return nil
 }
 
+// SetReadDeadline implements the net.Conn interface.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return errors.New(`SetReadDeadline not implemented`)
+	if !c.ok() {
+		return syscall.EINVAL
+	}
+	c.io.SetReadDeadline(t)
+	return nil
 }
 
+// SetWriteDeadline implements the net.Conn interface.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return errors.New(`SetWriteDeadline not implemented`)
+	if !c.ok() {
+		return syscall.EINVAL
+	}
+	c.io.SetWriteDeadline(t)
+	return nil
+}
+
+// deadlines holds a read/write deadline pair, plus the wake channels the
+// libax25 backend's waitIO uses to interrupt an in-flight select(2) when a
+// deadline changes. It is embedded by the stream (netFD), datagram (pktFD)
+// and KISS (kissCircuit) backends so they share the same bookkeeping.
+type deadlines struct {
+	mu                          sync.Mutex
+	readDeadline, writeDeadline time.Time
+	readWake, writeWake         chan struct{}
+}
+
+func (d *deadlines) read() (time.Time, chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.readWake == nil {
+		d.readWake = make(chan struct{})
+	}
+	return d.readDeadline, d.readWake
+}
+
+func (d *deadlines) write() (time.Time, chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.writeWake == nil {
+		d.writeWake = make(chan struct{})
+	}
+	return d.writeDeadline, d.writeWake
+}
+
+// SetReadDeadline stores t and wakes any Read currently blocked in select(2)
+// so it can pick up the new deadline.
+func (d *deadlines) SetReadDeadline(t time.Time) {
+	d.mu.Lock()
+	d.readDeadline = t
+	old := d.readWake
+	d.readWake = make(chan struct{})
+	d.mu.Unlock()
+	if old != nil {
+		close(old)
+	}
+}
+
+// SetWriteDeadline stores t and wakes any Write currently blocked in
+// select(2) so it can pick up the new deadline.
+func (d *deadlines) SetWriteDeadline(t time.Time) {
+	d.mu.Lock()
+	d.writeDeadline = t
+	old := d.writeWake
+	d.writeWake = make(chan struct{})
+	d.mu.Unlock()
+	if old != nil {
+		close(old)
+	}
+}
+
+// packetIO is the I/O implementation backing a NetROMPacketConn, supplied by
+// the platform-specific backend exactly as connIO backs Conn.
+type packetIO interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+
+	SetReadDeadline(time.Time)
+	SetWriteDeadline(time.Time)
+}
+
+// NetROMPacketConn implements net.PacketConn for NetROM SOCK_DGRAM sockets.
+//
+// Unlike Conn (which uses SOCK_SEQPACKET and holds open a virtual circuit),
+// a NetROMPacketConn sends and receives unreliable NET/ROM Information
+// frames directly, with no connection setup or acknowledgement. This is the
+// mode used for nodes broadcasts, keepalives and chat.
+type NetROMPacketConn struct {
+	io         packetIO
+	localAddr  NetROMAddr
+	remoteAddr *NetROMAddr // set by DialNetROMPacket; nil for a Listen'd socket
+}
+
+func (pc *NetROMPacketConn) ok() bool { return pc != nil && pc.io != nil }
+
+func (pc *NetROMPacketConn) LocalAddr() net.Addr {
+	if !pc.ok() {
+		return nil
+	}
+	return pc.localAddr
+}
+
+// RemoteAddr returns the address this NetROMPacketConn was connected to with
+// DialNetROMPacket, or nil if it was created with ListenNetROMPacket.
+func (pc *NetROMPacketConn) RemoteAddr() net.Addr {
+	if !pc.ok() || pc.remoteAddr == nil {
+		return nil
+	}
+	return *pc.remoteAddr
+}
+
+// Read implements net.Conn for a connected NetROMPacketConn (see
+// DialNetROMPacket).
+func (pc *NetROMPacketConn) Read(p []byte) (int, error) {
+	if !pc.ok() {
+		return 0, syscall.EINVAL
+	}
+	return pc.io.Read(p)
+}
+
+// Write implements net.Conn for a connected NetROMPacketConn (see
+// DialNetROMPacket).
+func (pc *NetROMPacketConn) Write(p []byte) (int, error) {
+	if !pc.ok() {
+		return 0, syscall.EINVAL
+	}
+	return pc.io.Write(p)
+}
+
+func (pc *NetROMPacketConn) Close() error {
+	if !pc.ok() {
+		return syscall.EINVAL
+	}
+	return pc.io.Close()
+}
+
+// ReadFrom reads a single datagram into p, returning the number of bytes
+// read and the address it was sent from.
+func (pc *NetROMPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if !pc.ok() {
+		return 0, nil, syscall.EINVAL
+	}
+	return pc.io.ReadFrom(p)
+}
+
+// WriteTo writes p as a single datagram addressed to addr, which must be a
+// NetROMAddr from the libax25 backend, such as one returned by ReadFrom.
+func (pc *NetROMPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !pc.ok() {
+		return 0, syscall.EINVAL
+	}
+	return pc.io.WriteTo(p, addr)
+}
+
+// SetDeadline implements the net.Conn and net.PacketConn interfaces.
+func (pc *NetROMPacketConn) SetDeadline(t time.Time) error {
+	if !pc.ok() {
+		return syscall.EINVAL
+	}
+	pc.io.SetReadDeadline(t)
+	pc.io.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn and net.PacketConn interfaces.
+func (pc *NetROMPacketConn) SetReadDeadline(t time.Time) error {
+	if !pc.ok() {
+		return syscall.EINVAL
+	}
+	pc.io.SetReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn and net.PacketConn interfaces.
+func (pc *NetROMPacketConn) SetWriteDeadline(t time.Time) error {
+	if !pc.ok() {
+		return syscall.EINVAL
+	}
+	pc.io.SetWriteDeadline(t)
+	return nil
 }
 
 type Beacon interface {
@@ -96,10 +96,16 @@ func (ln netromListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
+	nf, err := newFD(nfd)
+	if err != nil {
+		nfd.close()
+		return nil, err
+	}
+
 	conn := &Conn{
-		localAddr:       ln.localAddr,
-		remoteAddr:      NetROMAddr{addr},
-		ReadWriteCloser: os.NewFile(uintptr(nfd), ""),
+		localAddr:  ln.localAddr,
+		remoteAddr: NetROMAddr{addr},
+		io:         nf,
 	}
 
 	return conn, nil
@@ -173,60 +179,177 @@ func DialNetROMTimeout(nrPort, mycall, targetcall string, timeout time.Duration)
 		return nil, err
 	}
 
+	nf, err := newFD(socket)
+	if err != nil {
+		socket.close()
+		return nil, err
+	}
+
 	return &Conn{
-		ReadWriteCloser: os.NewFile(uintptr(socket), nrPort),
-		localAddr:       NetROMAddr{localAddr},
-		remoteAddr:      NetROMAddr{remoteAddr},
+		io:         nf,
+		localAddr:  NetROMAddr{localAddr},
+		remoteAddr: NetROMAddr{remoteAddr},
 	}, nil
 }
 
-func (c *Conn) Close() error {
-	if !c.ok() {
-		return syscall.EINVAL
+// readFD reads from sock, blocking on waitIO (and retrying) while the
+// deadlines in d allow it, translating errnos structurally instead of by
+// matching on an *os.PathError string as the previous os.File-backed
+// implementation did.
+func readFD(sock fd, p []byte, d *deadlines) (int, error) {
+	for {
+		deadline, wake := d.read()
+
+		n, err := syscall.Read(int(sock), p)
+		switch err {
+		case nil:
+			return n, nil
+		case syscall.EAGAIN:
+			werr := sock.waitIO(false, deadline, wake)
+			if werr != nil && werr != errDeadlineChanged {
+				return 0, werr
+			}
+		case syscall.EINTR:
+			// retry
+		case syscall.ENOTCONN, syscall.EPIPE:
+			// The remote hung up.
+			return n, io.EOF
+		case syscall.ECONNRESET:
+			return n, &net.OpError{Op: "read", Net: _NETWORK, Addr: nil, Err: err}
+		default:
+			return n, err
+		}
 	}
+}
 
-	return c.ReadWriteCloser.Close()
+// writeFD is the writeFD counterpart to readFD.
+func writeFD(sock fd, p []byte, d *deadlines) (int, error) {
+	for {
+		deadline, wake := d.write()
+
+		n, err := syscall.Write(int(sock), p)
+		switch err {
+		case nil:
+			return n, nil
+		case syscall.EAGAIN:
+			werr := sock.waitIO(true, deadline, wake)
+			if werr != nil && werr != errDeadlineChanged {
+				return 0, werr
+			}
+		case syscall.EINTR:
+			// retry
+		case syscall.EMSGSIZE:
+			return 0, ErrMessageTooLong
+		case syscall.ENOTCONN, syscall.EPIPE:
+			return 0, io.EOF
+		case syscall.ECONNRESET:
+			return 0, &net.OpError{Op: "write", Net: _NETWORK, Addr: nil, Err: err}
+		default:
+			return n, err
+		}
+	}
 }
 
-func (c *Conn) Write(p []byte) (n int, err error) {
-	if !c.ok() {
-		return 0, syscall.EINVAL
+// netFD implements connIO directly on top of a raw socket file descriptor,
+// performing I/O via the syscall package instead of wrapping the fd in an
+// *os.File. This lets errnos be translated structurally (see readFD/writeFD)
+// rather than by matching on (*os.PathError).Err.Error() strings, and lets
+// Close shut down both directions via shutdown(2) before closing the fd.
+type netFD struct {
+	sysfd fd
+	deadlines
+}
+
+// newFD wraps sysfd in a netFD, putting it into non-blocking mode for the
+// life of the connection so readFD/writeFD actually see EAGAIN (and fall
+// into waitIO's deadline-aware wait) instead of blocking in the kernel past
+// any deadline set via SetReadDeadline/SetWriteDeadline.
+func newFD(sysfd fd) (*netFD, error) {
+	if err := syscall.SetNonblock(int(sysfd), true); err != nil {
+		return nil, err
 	}
+	return &netFD{sysfd: sysfd}, nil
+}
+
+func (nfd *netFD) Read(p []byte) (int, error)  { return readFD(nfd.sysfd, p, &nfd.deadlines) }
+func (nfd *netFD) Write(p []byte) (int, error) { return writeFD(nfd.sysfd, p, &nfd.deadlines) }
+
+func (nfd *netFD) Close() error {
+	syscall.Shutdown(int(nfd.sysfd), syscall.SHUT_RDWR)
+	return nfd.sysfd.close()
+}
+
+// netromError implements net.Error for failures originating from waitIO,
+// in particular read/write deadline expiry.
+type netromError struct{ syscall.Errno }
+
+func (e netromError) Timeout() bool   { return e.Errno == syscall.ETIMEDOUT }
+func (e netromError) Temporary() bool { return e.Timeout() }
 
-	n, err = c.ReadWriteCloser.Write(p)
-	perr, ok := err.(*os.PathError)
-	if !ok {
-		return
+var errTimeout error = netromError{syscall.ETIMEDOUT}
+
+// errDeadlineChanged is returned by waitIO when it was interrupted by a
+// concurrent SetDeadline/SetReadDeadline/SetWriteDeadline call rather than by
+// the socket becoming ready or the deadline expiring. Callers should re-read
+// the (now current) deadline and call waitIO again.
+var errDeadlineChanged = fmt.Errorf("netrom: deadline changed")
+
+// waitIO blocks until sock is ready for the requested direction (write if
+// write is true, read otherwise), the deadline expires, or wake is closed
+// (signalling that SetDeadline/SetReadDeadline/SetWriteDeadline was called
+// with a new value while we were waiting).
+//
+// It reuses the self-pipe trick from waitRead: a pipe is included in the
+// select(2) fd set so a concurrent deadline change can interrupt the wait.
+func (sock fd) waitIO(write bool, deadline time.Time, wake <-chan struct{}) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return errTimeout
 	}
 
-	switch perr.Err.Error() {
-	case "message too long":
-		return n, ErrMessageTooLong
-	default:
-		return
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
 	}
-}
+	defer pr.Close()
 
-func (c *Conn) Read(p []byte) (n int, err error) {
-	if !c.ok() {
-		return 0, syscall.EINVAL
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-wake:
+			pw.Write([]byte{0})
+		case <-done:
+		}
+	}()
+	defer func() { close(done); pw.Close() }()
+
+	var tv *syscall.Timeval
+	if !deadline.IsZero() {
+		t := syscall.NsecToTimeval(int64(time.Until(deadline)))
+		tv = &t
 	}
 
-	n, err = c.ReadWriteCloser.Read(p)
-	perr, ok := err.(*os.PathError)
-	if !ok {
-		return
+	rset := new(syscall.FdSet)
+	wset := new(syscall.FdSet)
+	maxFd := fdSet(rset, int(pr.Fd()))
+	if write {
+		if m := fdSet(wset, int(sock)); m > maxFd {
+			maxFd = m
+		}
+	} else {
+		if m := fdSet(rset, int(sock)); m > maxFd {
+			maxFd = m
+		}
 	}
 
-	//TODO: These errors should not be checked using string comparison!
-	// The weird error handling here is needed because of how the *os.File treats
-	// the underlying fd. This should be fixed the same way as net.FileConn does.
-	switch perr.Err.Error() {
-	case "transport endpoint is not connected": // We get this error when the remote hangs up
-		return n, io.EOF
-	default:
-		return
+	n, err := syscall.Select(maxFd+1, rset, wset, nil, tv)
+	if n < 0 || err != nil {
+		return err
+	} else if n == 0 {
+		return errTimeout
+	} else if fdIsSet(rset, int(pr.Fd())) {
+		return errDeadlineChanged
 	}
+	return nil // sock is ready
 }
 
 // DialNetROM connects to the remote station targetcall using the named nrPort and mycall.
@@ -283,7 +406,9 @@ func (sock fd) connectTimeout(addr ax25Addr, timeout time.Duration) (err error)
 		}
 	}
 
-	syscall.SetNonblock(int(sock), false)
+	// Leave sock non-blocking: newFD keeps it that way for the life of the
+	// connection so readFD/writeFD see EAGAIN instead of blocking in the
+	// kernel past a deadline.
 	return
 }
 
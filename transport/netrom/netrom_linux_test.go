@@ -0,0 +1,124 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+// +build libax25
+
+package netrom
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socketpair returns a connected pair of AF_UNIX/SOCK_STREAM descriptors,
+// used as a stand-in for a NetROM SOCK_SEQPACKET connection so the
+// select(2)-based deadline logic can be exercised without real AX.25
+// hardware.
+func socketpair(t *testing.T) (a, b fd) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	return fd(fds[0]), fd(fds[1])
+}
+
+func TestWaitIOTimeout(t *testing.T) {
+	a, b := socketpair(t)
+	defer a.close()
+	defer b.close()
+
+	err := a.waitIO(false, time.Now().Add(50*time.Millisecond), nil)
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Fatalf("waitIO: expected a timeout net.Error, got %v", err)
+	}
+}
+
+func TestWaitIOReady(t *testing.T) {
+	a, b := socketpair(t)
+	defer a.close()
+	defer b.close()
+
+	if _, err := syscall.Write(int(b), []byte("hi")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := a.waitIO(false, time.Time{}, nil); err != nil {
+		t.Fatalf("waitIO: unexpected error: %v", err)
+	}
+}
+
+func TestWaitIODeadlineChanged(t *testing.T) {
+	a, b := socketpair(t)
+	defer a.close()
+	defer b.close()
+
+	wake := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- a.waitIO(false, time.Now().Add(time.Second), wake)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(wake)
+
+	select {
+	case err := <-done:
+		if err != errDeadlineChanged {
+			t.Fatalf("waitIO: expected errDeadlineChanged, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitIO: did not return after deadline change")
+	}
+}
+
+func TestNetFDReadClose(t *testing.T) {
+	a, b := socketpair(t)
+	defer b.close()
+
+	fda, err := newFD(a)
+	if err != nil {
+		t.Fatalf("newFD: %v", err)
+	}
+	if _, err := syscall.Write(int(b), []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	n, err := fda.Read(buf)
+	if err != nil {
+		t.Fatalf("netFD.Read: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("netFD.Read: got %q, want %q", buf[:n], "hello")
+	}
+
+	if err := fda.Close(); err != nil {
+		t.Fatalf("netFD.Close: %v", err)
+	}
+}
+
+func TestConnSetReadDeadlinePastTime(t *testing.T) {
+	a, b := socketpair(t)
+	defer b.close()
+
+	nf, err := newFD(a)
+	if err != nil {
+		t.Fatalf("newFD: %v", err)
+	}
+	c := &Conn{io: nf}
+	if err := c.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+
+	_, err = c.Read(make([]byte, 1))
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Fatalf("Read: expected a timeout net.Error for a deadline in the past, got %v", err)
+	}
+	c.Close()
+}
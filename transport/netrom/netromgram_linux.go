@@ -0,0 +1,200 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+// +build libax25
+
+package netrom
+
+/*
+#include <sys/socket.h>
+*/
+import "C"
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/la5nta/wl2k-go/transport"
+)
+
+func init() {
+	transport.RegisterDialer("netromgram", PacketDialer{})
+}
+
+// ListenNetROMPacket announces on the local port nrPort using mycall as the
+// local address, for sending and receiving unconnected NET/ROM datagrams.
+//
+// An error will be returned if nrPort is empty.
+func ListenNetROMPacket(nrPort, mycall string) (*NetROMPacketConn, error) {
+	if err := checkPort(nrPort); err != nil {
+		return nil, err
+	}
+
+	localAddr := newNetROMAddr(mycall)
+	if err := localAddr.setPort(nrPort); err != nil {
+		return nil, err
+	}
+
+	var socket fd
+	if f, err := syscall.Socket(syscall.AF_NETROM, syscall.SOCK_DGRAM, 0); err != nil {
+		return nil, err
+	} else {
+		socket = fd(f)
+	}
+
+	if err := socket.bind(localAddr); err != nil {
+		socket.close()
+		return nil, err
+	}
+
+	return &NetROMPacketConn{io: newPktFD(socket), localAddr: NetROMAddr{localAddr}}, nil
+}
+
+// DialNetROMPacket acts like ListenNetROMPacket, but also connects the
+// socket to targetcall so Read/Write can be used in addition to
+// ReadFrom/WriteTo.
+func DialNetROMPacket(nrPort, mycall, targetcall string) (*NetROMPacketConn, error) {
+	if err := checkPort(nrPort); err != nil {
+		return nil, err
+	}
+
+	localAddr := newNetROMAddr(mycall)
+	if err := localAddr.setPort(nrPort); err != nil {
+		return nil, err
+	}
+	remoteAddr := newNetROMAddr(targetcall)
+
+	var socket fd
+	if f, err := syscall.Socket(syscall.AF_NETROM, syscall.SOCK_DGRAM, 0); err != nil {
+		return nil, err
+	} else {
+		socket = fd(f)
+	}
+
+	if err := socket.bind(localAddr); err != nil {
+		socket.close()
+		return nil, err
+	}
+	if err := socket.connect(remoteAddr); err != nil {
+		socket.close()
+		return nil, err
+	}
+
+	ra := NetROMAddr{remoteAddr}
+	return &NetROMPacketConn{
+		io:         newPktFD(socket),
+		localAddr:  NetROMAddr{localAddr},
+		remoteAddr: &ra,
+	}, nil
+}
+
+// pktFD implements packetIO directly on top of a raw NET/ROM SOCK_DGRAM
+// socket, mirroring netFD's approach for SOCK_SEQPACKET.
+type pktFD struct {
+	sysfd fd
+	deadlines
+}
+
+func newPktFD(sysfd fd) *pktFD {
+	syscall.SetNonblock(int(sysfd), true)
+	return &pktFD{sysfd: sysfd}
+}
+
+func (pfd *pktFD) Read(p []byte) (int, error)  { return readFD(pfd.sysfd, p, &pfd.deadlines) }
+func (pfd *pktFD) Write(p []byte) (int, error) { return writeFD(pfd.sysfd, p, &pfd.deadlines) }
+func (pfd *pktFD) Close() error                { return pfd.sysfd.close() }
+
+// ReadFrom reads a single datagram into p, returning the number of bytes
+// read and the address it was sent from.
+func (pfd *pktFD) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		deadline, wake := pfd.deadlines.read()
+
+		var from ax25Addr
+		addrLen := C.socklen_t(unsafe.Sizeof(from))
+		var buf unsafe.Pointer
+		if len(p) > 0 {
+			buf = unsafe.Pointer(&p[0])
+		}
+		rn, cerr := C.recvfrom(
+			C.int(pfd.sysfd),
+			buf,
+			C.size_t(len(p)),
+			0,
+			(*C.struct_sockaddr)(unsafe.Pointer(&from)),
+			&addrLen,
+		)
+		if rn >= 0 {
+			return int(rn), NetROMAddr{from}, nil
+		}
+
+		switch cerr {
+		case syscall.EAGAIN:
+			werr := pfd.sysfd.waitIO(false, deadline, wake)
+			if werr != nil && werr != errDeadlineChanged {
+				return 0, nil, werr
+			}
+		case syscall.EINTR:
+			// retry
+		default:
+			return 0, nil, cerr
+		}
+	}
+}
+
+// WriteTo writes p as a single datagram addressed to addr, which must be a
+// NetROMAddr wrapping an ax25Addr, such as one returned by ReadFrom.
+func (pfd *pktFD) WriteTo(p []byte, addr net.Addr) (int, error) {
+	nra, ok := addr.(NetROMAddr)
+	if !ok {
+		return 0, &net.AddrError{Err: "netrom: invalid address type", Addr: addr.String()}
+	}
+	raw, ok := nra.addr.(ax25Addr)
+	if !ok {
+		return 0, &net.AddrError{Err: "netrom: invalid address type", Addr: addr.String()}
+	}
+
+	for {
+		deadline, wake := pfd.deadlines.write()
+
+		var buf unsafe.Pointer
+		if len(p) > 0 {
+			buf = unsafe.Pointer(&p[0])
+		}
+		wn, cerr := C.sendto(
+			C.int(pfd.sysfd),
+			buf,
+			C.size_t(len(p)),
+			0,
+			(*C.struct_sockaddr)(unsafe.Pointer(&raw)),
+			C.socklen_t(unsafe.Sizeof(raw)),
+		)
+		if wn >= 0 {
+			return int(wn), nil
+		}
+
+		switch cerr {
+		case syscall.EAGAIN:
+			werr := pfd.sysfd.waitIO(true, deadline, wake)
+			if werr != nil && werr != errDeadlineChanged {
+				return 0, werr
+			}
+		case syscall.EINTR:
+			// retry
+		case syscall.EMSGSIZE:
+			return 0, ErrMessageTooLong
+		default:
+			return 0, cerr
+		}
+	}
+}
+
+// PacketDialer dials the "netromgram" transport.URL scheme, producing a
+// NetROMPacketConn connected to the target callsign.
+type PacketDialer struct{}
+
+func (d PacketDialer) DialURL(url *transport.URL) (net.Conn, error) {
+	return DialNetROMPacket(url.Host, url.User.Username(), url.Target)
+}
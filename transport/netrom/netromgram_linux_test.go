@@ -0,0 +1,42 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+// +build libax25
+
+package netrom
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestPktFDWrite(t *testing.T) {
+	a, b := socketpair(t)
+	defer a.close()
+	defer b.close()
+
+	pa := newPktFD(a)
+	if _, err := pa.Write([]byte("hello")); err != nil {
+		t.Fatalf("pktFD.Write: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	n, err := syscall.Read(int(b), buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("pktFD.Write: peer got %q, want %q", buf[:n], "hello")
+	}
+}
+
+func TestNetROMPacketConnOkOnNil(t *testing.T) {
+	var pc *NetROMPacketConn
+	if _, err := pc.Read(nil); err != syscall.EINVAL {
+		t.Fatalf("Read on nil *NetROMPacketConn: got %v, want EINVAL", err)
+	}
+	if pc.LocalAddr() != nil {
+		t.Fatalf("LocalAddr on nil *NetROMPacketConn: expected nil")
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+// +build !libax25
+
+package netrom
+
+func ListenNetROMPacket(nrPort, mycall string) (*NetROMPacketConn, error) { return nil, ErrNoLibax25 }
+
+func DialNetROMPacket(nrPort, mycall, targetcall string) (*NetROMPacketConn, error) {
+	return nil, ErrNoLibax25
+}
@@ -0,0 +1,283 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package netrom
+
+// Nodes and Routes expose the Linux kernel's NET/ROM nodes and neighbour
+// tables, as published in text form under /proc/net/nr_nodes and
+// /proc/net/nr_neigh. Unlike the rest of this package's Linux backend,
+// reading these files needs neither libax25 nor cgo, so (unlike Heard, see
+// heard_other.go) they are available in every build.
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Node is a single route to Callsign (reachable via Neighbour) as carried
+// in one entry of the kernel's NET/ROM nodes table.
+//
+// Digipeaters is always empty: /proc/net/nr_nodes does not record an AX.25
+// digipeater path, only the next-hop Neighbour.
+type Node struct {
+	Callsign     Address
+	Alias        string
+	Quality      int
+	Obsolescence int
+	Neighbour    Address
+	Digipeaters  []Address
+	NRPort       string
+}
+
+// Route is a NET/ROM neighbour, as carried in one entry of the kernel's
+// neighbour table.
+type Route struct {
+	// Addr is the neighbour's numeric index into the kernel's neighbour
+	// table, as printed (zero-padded) in the table's own addr column. It
+	// is also how a neighbour is identified in /proc/net/nr_nodes (see
+	// parseNrNodes) — nr_nodes carries no callsign of its own for it.
+	Addr     string
+	Callsign Address
+	Device   string
+	Quality  int
+	Locked   bool
+	Count    int
+	UseCount int
+}
+
+const (
+	procNrNodes = "/proc/net/nr_nodes"
+	procNrNeigh = "/proc/net/nr_neigh"
+)
+
+// Routes returns the kernel's NET/ROM neighbour table. If nrPort is
+// non-empty, only neighbours reachable over that device are returned.
+//
+// nrPort is matched directly against the kernel device name (e.g. "ax0"):
+// resolving a configured nrports alias to its device, as checkPort does for
+// the libax25 backend, needs axconfig/nrconfig and is not available here.
+func Routes(nrPort string) ([]Route, error) {
+	f, err := os.Open(procNrNeigh)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNrNeigh(f, nrPort)
+}
+
+func parseNrNeigh(r io.Reader, nrPort string) ([]Route, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header: "addr  callsign  dev  qual lock count failed"
+
+	var routes []Route
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		dev := fields[2]
+		if nrPort != "" && dev != nrPort {
+			continue
+		}
+		routes = append(routes, Route{
+			Addr:     fields[0],
+			Callsign: AddressFromString(fields[1]),
+			Device:   dev,
+			Quality:  atoiOr0(fields[3]),
+			Locked:   atoiOr0(fields[4]) != 0,
+			Count:    atoiOr0(fields[5]),
+			UseCount: atoiOr0(fields[6]),
+		})
+	}
+	return routes, scanner.Err()
+}
+
+// Nodes returns the kernel's NET/ROM nodes table, one Node per destination
+// per known route to it. If nrPort is non-empty, only nodes reached via a
+// neighbour on that device are returned (see Routes for the nrPort
+// matching caveat).
+func Nodes(nrPort string) ([]Node, error) {
+	f, err := os.Open(procNrNodes)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Best effort: cross-reference with the neighbour table, since the
+	// nodes table identifies each neighbour only by its numeric addr (see
+	// parseNrNodes below), not by callsign or device name.
+	neighbours := make(map[string]Route)
+	if routes, err := Routes(""); err == nil {
+		for _, r := range routes {
+			neighbours[r.Addr] = r
+		}
+	}
+
+	return parseNrNodes(f, nrPort, neighbours)
+}
+
+func parseNrNodes(r io.Reader, nrPort string, neighbours map[string]Route) ([]Node, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header: "callsign  mnemonic w n  qual  obs  neighbour"
+
+	var nodes []Node
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+
+		dest := AddressFromString(fields[0])
+		alias := fields[1]
+		if alias == "*" {
+			alias = ""
+		}
+		count := atoiOr0(fields[3])
+
+		routeFields := fields[4:]
+		for i := 0; i < count && (i+1)*3 <= len(routeFields); i++ {
+			// routeFields[i*3+2] is the neighbour's numeric addr (as
+			// printed by the kernel's nr_node_show, matching the addr
+			// column of /proc/net/nr_neigh), not a callsign: resolve it
+			// via the neighbour table to learn who it actually is.
+			route := neighbours[routeFields[i*3+2]]
+			node := Node{
+				Callsign:     dest,
+				Alias:        alias,
+				Quality:      atoiOr0(routeFields[i*3]),
+				Obsolescence: atoiOr0(routeFields[i*3+1]),
+				Neighbour:    route.Callsign,
+				NRPort:       route.Device,
+			}
+			if nrPort == "" || node.NRPort == nrPort {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	return nodes, scanner.Err()
+}
+
+func atoiOr0(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// NodesEventType identifies what changed in a NodesEvent.
+type NodesEventType int
+
+const (
+	NodeAdded NodesEventType = iota
+	NodeRemoved
+	NodeChanged
+)
+
+// NodesEvent describes a single node route appearing, disappearing, or
+// changing quality/obsolescence between two polls of Watch.
+type NodesEvent struct {
+	Type NodesEventType
+	Node Node
+}
+
+// nodeKey identifies a route within the nodes table for diffing purposes: a
+// destination can have several routes, one per neighbour.
+type nodeKey struct {
+	Callsign, Neighbour Address
+}
+
+// Watch polls Nodes(nrPort) every interval (or every minute, if interval is
+// non-positive), emitting a NodesEvent for every route added, removed, or
+// changed since the previous poll, until ctx is canceled. The first poll's
+// routes are all reported as NodeAdded.
+//
+// The returned channel is closed when ctx is done. A poll that errors
+// (e.g. a transient read failure) is silently skipped; Watch itself only
+// returns an error if the initial poll fails.
+func Watch(ctx context.Context, nrPort string, interval time.Duration) (<-chan NodesEvent, error) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	prev, err := Nodes(nrPort)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan NodesEvent)
+	go func() {
+		defer close(ch)
+		send := func(e NodesEvent) bool {
+			select {
+			case ch <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, n := range prev {
+			if !send(NodesEvent{Type: NodeAdded, Node: n}) {
+				return
+			}
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cur, err := Nodes(nrPort)
+				if err != nil {
+					continue
+				}
+				if !diffNodes(prev, cur, send) {
+					return
+				}
+				prev = cur
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// diffNodes reports the routes added, removed or changed between prev and
+// cur via send, stopping (and returning false) as soon as send does.
+func diffNodes(prev, cur []Node, send func(NodesEvent) bool) bool {
+	prevByKey := make(map[nodeKey]Node, len(prev))
+	for _, n := range prev {
+		prevByKey[nodeKey{n.Callsign, n.Neighbour}] = n
+	}
+	curByKey := make(map[nodeKey]Node, len(cur))
+	for _, n := range cur {
+		curByKey[nodeKey{n.Callsign, n.Neighbour}] = n
+	}
+
+	for key, n := range curByKey {
+		old, ok := prevByKey[key]
+		switch {
+		case !ok:
+			if !send(NodesEvent{Type: NodeAdded, Node: n}) {
+				return false
+			}
+		case old.Quality != n.Quality || old.Obsolescence != n.Obsolescence || old.Alias != n.Alias:
+			if !send(NodesEvent{Type: NodeChanged, Node: n}) {
+				return false
+			}
+		}
+	}
+	for key, n := range prevByKey {
+		if _, ok := curByKey[key]; !ok {
+			if !send(NodesEvent{Type: NodeRemoved, Node: n}) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package netrom
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleNrNeigh = `addr  callsign  dev  qual lock count failed
+00001 LA5NTA-1  ax0  196  0    3     0
+00002 LA1B-2    ax0  128  1    1     2
+`
+
+func TestParseNrNeigh(t *testing.T) {
+	routes, err := parseNrNeigh(strings.NewReader(sampleNrNeigh), "")
+	if err != nil {
+		t.Fatalf("parseNrNeigh: %v", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("parseNrNeigh: got %d routes, want 2", len(routes))
+	}
+	want := Route{Addr: "00001", Callsign: Address{Call: "LA5NTA", SSID: 1}, Device: "ax0", Quality: 196, Locked: false, Count: 3, UseCount: 0}
+	if routes[0] != want {
+		t.Fatalf("parseNrNeigh: got %+v, want %+v", routes[0], want)
+	}
+	if !routes[1].Locked {
+		t.Fatalf("parseNrNeigh: LA1B-2 should be locked")
+	}
+}
+
+func TestParseNrNeighFilterByDevice(t *testing.T) {
+	routes, err := parseNrNeigh(strings.NewReader(sampleNrNeigh), "ax1")
+	if err != nil {
+		t.Fatalf("parseNrNeigh: %v", err)
+	}
+	if len(routes) != 0 {
+		t.Fatalf("parseNrNeigh: got %d routes for ax1, want 0", len(routes))
+	}
+}
+
+// The neighbour column (the 3rd field of each route triple) is the
+// neighbour's numeric addr, as the kernel actually prints it — not a
+// callsign; see sampleNrNeigh for the addrs these resolve against.
+const sampleNrNodes = `callsign  mnemonic w n  qual  obs  neighbour
+LA2RR-5   GATEWY   2  2  196  6  00001     128  3  00002
+N0CALL    *        1  1  255  6  00001
+`
+
+func TestParseNrNodes(t *testing.T) {
+	neighbours := map[string]Route{
+		"00001": {Callsign: Address{Call: "LA5NTA", SSID: 1}, Device: "ax0"},
+	}
+	nodes, err := parseNrNodes(strings.NewReader(sampleNrNodes), "", neighbours)
+	if err != nil {
+		t.Fatalf("parseNrNodes: %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("parseNrNodes: got %d nodes, want 3", len(nodes))
+	}
+
+	first := nodes[0]
+	want := Node{
+		Callsign:  Address{Call: "LA2RR", SSID: 5},
+		Alias:     "GATEWY",
+		Quality:   196,
+		Neighbour: Address{Call: "LA5NTA", SSID: 1},
+		NRPort:    "ax0",
+	}
+	if first.Callsign != want.Callsign || first.Alias != want.Alias || first.Quality != want.Quality ||
+		first.Neighbour != want.Neighbour || first.NRPort != want.NRPort || len(first.Digipeaters) != 0 {
+		t.Fatalf("parseNrNodes: got %+v, want %+v", first, want)
+	}
+
+	last := nodes[2]
+	if last.Alias != "" {
+		t.Fatalf("parseNrNodes: N0CALL has mnemonic %q, want empty for \"*\"", last.Alias)
+	}
+}
+
+func TestParseNrNodesFilterByNRPort(t *testing.T) {
+	neighbours := map[string]Route{
+		"00001": {Callsign: Address{Call: "LA5NTA", SSID: 1}, Device: "ax0"},
+		"00002": {Callsign: Address{Call: "LA1B", SSID: 2}, Device: "ax1"},
+	}
+	nodes, err := parseNrNodes(strings.NewReader(sampleNrNodes), "ax1", neighbours)
+	if err != nil {
+		t.Fatalf("parseNrNodes: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].Neighbour.Call != "LA1B" {
+		t.Fatalf("parseNrNodes: got %+v, want a single route via LA1B-2", nodes)
+	}
+}
+
+func TestDiffNodes(t *testing.T) {
+	a := Node{Callsign: Address{Call: "AAAAAA"}, Neighbour: Address{Call: "NEIGH1"}, Quality: 100}
+	b := Node{Callsign: Address{Call: "BBBBBB"}, Neighbour: Address{Call: "NEIGH2"}, Quality: 100}
+	bChanged := b
+	bChanged.Quality = 50
+
+	var events []NodesEvent
+	send := func(e NodesEvent) bool { events = append(events, e); return true }
+
+	if !diffNodes([]Node{a, b}, []Node{a, bChanged}, send) {
+		t.Fatal("diffNodes: send should not have stopped early")
+	}
+	if len(events) != 1 || events[0].Type != NodeChanged || events[0].Node.Neighbour.Call != "NEIGH2" {
+		t.Fatalf("diffNodes: got %+v, want a single NodeChanged for NEIGH2", events)
+	}
+
+	events = nil
+	diffNodes([]Node{a, b}, []Node{a}, send)
+	if len(events) != 1 || events[0].Type != NodeRemoved {
+		t.Fatalf("diffNodes: got %+v, want a single NodeRemoved", events)
+	}
+
+	events = nil
+	diffNodes([]Node{a}, []Node{a, b}, send)
+	if len(events) != 1 || events[0].Type != NodeAdded {
+		t.Fatalf("diffNodes: got %+v, want a single NodeAdded", events)
+	}
+}